@@ -0,0 +1,39 @@
+package dnsredir
+
+import (
+	"context"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// Dnsredir is the plugin handler: it answers NXDOMAIN for any query whose
+// name matches the configured Namelist, and falls through to Next otherwise
+type Dnsredir struct {
+	Next plugin.Handler
+	*Namelist
+}
+
+// Name implements the plugin.Handler interface
+func (d *Dnsredir) Name() string { return "dnsredir" }
+
+// ServeDNS implements the plugin.Handler interface
+func (d *Dnsredir) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+	state := request.Request{W: w, Req: r}
+	qname := strings.TrimSuffix(state.Name(), ".")
+	if qname == "" || !d.Namelist.Match(qname) {
+		return plugin.NextOrFailure(d.Name(), d.Next, ctx, w, r)
+	}
+
+	m := new(dns.Msg)
+	m.SetRcode(r, dns.RcodeNameError)
+	m.Authoritative = true
+
+	if err := w.WriteMsg(m); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return dns.RcodeNameError, nil
+}
@@ -0,0 +1,301 @@
+package dnsredir
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// namelistFormat identifies the on-disk shape of a Nameitem's source
+type namelistFormat int
+
+const (
+	// formatAuto sniffs the format from the first non-comment, non-blank line
+	formatAuto namelistFormat = iota
+	// formatDomains is a plain list of bare domain names, one per line
+	formatDomains
+	// formatDnsmasq additionally understands dnsmasq's server=/<domain>/<?> lines
+	formatDnsmasq
+	// formatHosts is /etc/hosts style: "<ip> <host> [host...]"
+	formatHosts
+	// formatAdblock is AdBlock Plus/EasyList style filter syntax
+	formatAdblock
+	// formatRPZ is an RFC 5625-style response policy zone snippet
+	formatRPZ
+)
+
+func (f namelistFormat) String() string {
+	switch f {
+	case formatDomains:
+		return "domains"
+	case formatDnsmasq:
+		return "dnsmasq"
+	case formatHosts:
+		return "hosts"
+	case formatAdblock:
+		return "adblock"
+	case formatRPZ:
+		return "rpz"
+	default:
+		return "auto"
+	}
+}
+
+// ParseNamelistFormat maps a Corefile `format' directive value to its
+// internal representation. An empty string (or "auto") requests sniffing
+func ParseNamelistFormat(s string) (namelistFormat, error) {
+	switch strings.ToLower(s) {
+	case "", "auto":
+		return formatAuto, nil
+	case "domains":
+		return formatDomains, nil
+	case "dnsmasq":
+		return formatDnsmasq, nil
+	case "hosts":
+		return formatHosts, nil
+	case "adblock":
+		return formatAdblock, nil
+	case "rpz":
+		return formatRPZ, nil
+	default:
+		return formatAuto, fmt.Errorf("unknown namelist format %q", s)
+	}
+}
+
+// formatCounters tallies how a parse pass disposed of each line. parse logs
+// them in a debug line of their own, tagged with the format; the per-source
+// "Parsed"/"Fetched" debug lines that report the entry count don't include them
+type formatCounters struct {
+	added   uint64
+	allowed uint64
+	skipped uint64
+}
+
+// isCommentLine reports whether s(already trimmed) is a comment or header
+// line under any of the supported formats, used while sniffing
+func isCommentLine(s string) bool {
+	switch s[0] {
+	case '#', '!', ';':
+		return true
+	}
+	return strings.HasPrefix(s, "[Adblock")
+}
+
+// sniffFormat guesses a format from a single representative line
+func sniffFormat(s string) namelistFormat {
+	if strings.HasPrefix(s, "||") || strings.HasPrefix(s, "@@") {
+		return formatAdblock
+	}
+	if strings.HasPrefix(s, "server=/") {
+		return formatDnsmasq
+	}
+	if f := strings.Fields(s); len(f) >= 2 {
+		if net.ParseIP(f[0]) != nil {
+			return formatHosts
+		}
+		if len(f) >= 3 && strings.EqualFold(f[1], "CNAME") {
+			return formatRPZ
+		}
+	}
+	return formatDomains
+}
+
+// parseDnsmasqOrDomainsLine handles a bare domain name per line, dnsmasq's
+// server=/<domain>/<?> directive, and a handful of exception syntaxes that
+// punch a hole through an otherwise-blocked parent: a leading '@' or '!',
+// and dnsmasq's server=/<domain>/# ("use the default resolver for domain")
+func parseDnsmasqOrDomainsLine(line string, names, allow *domainSet, c *formatCounters) {
+	// server=/<domain>/# relies on the trailing '#', so it must be
+	// recognized before generic '#'-comment stripping below
+	trimmed := strings.TrimRight(line, " \t")
+	if strings.HasPrefix(trimmed, "server=/") && strings.HasSuffix(trimmed, "/#") {
+		domain := trimmed[len("server=/") : len(trimmed)-len("/#")]
+		if allow.Add(domain) {
+			c.allowed++
+		} else {
+			log.Warningf("%q isn't a domain name", domain)
+			c.skipped++
+		}
+		return
+	}
+
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+
+	f := strings.Split(line, "/")
+	if len(f) != 3 {
+		s := strings.TrimSpace(line)
+
+		exception := strings.HasPrefix(s, "@") || strings.HasPrefix(s, "!")
+		if exception {
+			s = s[1:]
+		}
+
+		set := names
+		if exception {
+			set = allow
+		}
+
+		if !set.Add(s) {
+			c.skipped++
+		} else if exception {
+			c.allowed++
+		} else {
+			c.added++
+		}
+		return
+	}
+
+	// Format: server=/<domain>/<?>
+	if f[0] != "server=" {
+		c.skipped++
+		return
+	}
+
+	// Don't check f[2], see: http://manpages.ubuntu.com/manpages/bionic/man8/dnsmasq.8.html
+	// Thus server=/<domain>/<ip> and server=/<domain>/ are both block entries;
+	// server=/<domain>/# is handled above as an exception
+
+	if names.Add(f[1]) {
+		c.added++
+	} else {
+		log.Warningf("%q isn't a domain name", f[1])
+		c.skipped++
+	}
+}
+
+// loopbackHosts are hostnames conventionally paired with loopback/broadcast
+// addresses in /etc/hosts that aren't meaningful as block entries
+var loopbackHosts = map[string]struct{}{
+	"localhost":             {},
+	"localhost.localdomain": {},
+	"local":                 {},
+	"broadcasthost":         {},
+	"ip6-localhost":         {},
+	"ip6-loopback":          {},
+}
+
+// parseHostsLine handles "<ip> <host> [host...]" lines as found in
+// /etc/hosts-style blocklists, e.g. "0.0.0.0 ads.example.com". blockIPs
+// restricts which source IPs count as blocking (the Corefile `hosts_block_ip`
+// directive); a nil/empty set means any IP blocks, matching sinkhole lists
+// where every entry is a block. Loopback host names such as localhost are
+// skipped whatever the IP
+func parseHostsLine(line string, names *domainSet, blockIPs map[string]struct{}, c *formatCounters) {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		line = line[:i]
+	}
+
+	f := strings.Fields(line)
+	if len(f) < 2 {
+		return
+	}
+	ip := net.ParseIP(f[0])
+	if ip == nil {
+		c.skipped++
+		return
+	}
+	if len(blockIPs) > 0 {
+		if _, ok := blockIPs[ip.String()]; !ok {
+			c.skipped++
+			return
+		}
+	}
+
+	for _, host := range f[1:] {
+		host = strings.ToLower(host)
+		if _, ok := loopbackHosts[host]; ok {
+			c.skipped++
+			continue
+		}
+		if names.Add(host) {
+			c.added++
+		} else {
+			log.Warningf("%q isn't a domain name", host)
+			c.skipped++
+		}
+	}
+}
+
+// parseAdblockLine handles AdBlock Plus/EasyList filter syntax. Cosmetic,
+// regex and element-hiding rules are silently skipped since they don't
+// translate to a DNS-level block/allow decision
+func parseAdblockLine(line string, names, allow *domainSet, c *formatCounters) {
+	s := strings.TrimSpace(line)
+	if s == "" || strings.HasPrefix(s, "!") || strings.HasPrefix(s, "[") {
+		return
+	}
+	if strings.Contains(s, "##") || strings.Contains(s, "#@#") {
+		// Element-hiding / cosmetic rule
+		c.skipped++
+		return
+	}
+	if strings.HasPrefix(s, "/") && strings.HasSuffix(s, "/") {
+		// Regex rule
+		c.skipped++
+		return
+	}
+
+	exception := strings.HasPrefix(s, "@@")
+	if exception {
+		s = s[len("@@"):]
+	}
+
+	var domain string
+	switch {
+	case strings.HasPrefix(s, "||"):
+		domain = s[len("||"):]
+		if i := strings.IndexAny(domain, "^/*"); i >= 0 {
+			domain = domain[:i]
+		}
+	case !strings.ContainsAny(s, "|*^$"):
+		// Plain "domain.tld" rule
+		domain = s
+	default:
+		// Path/option filters, wildcards, etc. don't map to a single domain
+		c.skipped++
+		return
+	}
+
+	set := names
+	if exception {
+		set = allow
+	}
+	if !set.Add(domain) {
+		log.Warningf("%q isn't a domain name", domain)
+		c.skipped++
+		return
+	}
+	if exception {
+		c.allowed++
+	} else {
+		c.added++
+	}
+}
+
+// parseRPZLine handles RFC 5625-style response policy zone snippets, e.g.
+// "bad.example.com CNAME ." which signals an NXDOMAIN policy for the owner name
+func parseRPZLine(line string, names *domainSet, c *formatCounters) {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+
+	f := strings.Fields(line)
+	if len(f) < 3 || !strings.EqualFold(f[1], "CNAME") {
+		return
+	}
+	if f[2] != "." {
+		// Not an NXDOMAIN policy, e.g. rpz-passthru/rpz-drop rewrites
+		c.skipped++
+		return
+	}
+
+	domain := strings.TrimSuffix(f[0], ".")
+	if names.Add(domain) {
+		c.added++
+	} else {
+		log.Warningf("%q isn't a domain name", domain)
+		c.skipped++
+	}
+}
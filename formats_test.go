@@ -0,0 +1,140 @@
+package dnsredir
+
+import "testing"
+
+func TestParseHostsLine(t *testing.T) {
+	cases := []struct {
+		name      string
+		line      string
+		blockIPs  map[string]struct{}
+		wantAdded []string
+		wantSkip  bool
+	}{
+		{
+			name:      "plain sinkhole entry",
+			line:      "0.0.0.0 ads.example.com",
+			wantAdded: []string{"ads.example.com"},
+		},
+		{
+			name:     "loopback host is skipped",
+			line:     "127.0.0.1 localhost",
+			wantSkip: true,
+		},
+		{
+			name:      "multiple hosts on one line",
+			line:      "0.0.0.0 a.example.com b.example.com",
+			wantAdded: []string{"a.example.com", "b.example.com"},
+		},
+		{
+			name:     "not an IP is skipped",
+			line:     "notanip ads.example.com",
+			wantSkip: true,
+		},
+		{
+			name:      "hosts_block_ip allows a configured IP",
+			line:      "0.0.0.0 ads.example.com",
+			blockIPs:  map[string]struct{}{"0.0.0.0": {}},
+			wantAdded: []string{"ads.example.com"},
+		},
+		{
+			name:     "hosts_block_ip skips a non-configured IP",
+			line:     "192.168.1.5 myrouter.local",
+			blockIPs: map[string]struct{}{"0.0.0.0": {}},
+			wantSkip: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			names := newDomainSet()
+			var c formatCounters
+			parseHostsLine(tc.line, &names, tc.blockIPs, &c)
+
+			if tc.wantSkip {
+				if c.added != 0 {
+					t.Errorf("added = %v, want 0", c.added)
+				}
+				return
+			}
+
+			for _, d := range tc.wantAdded {
+				if !names.Match(d) {
+					t.Errorf("expected %q to be added, names = %v", d, names)
+				}
+			}
+		})
+	}
+}
+
+func TestParseAdblockLine(t *testing.T) {
+	cases := []struct {
+		name        string
+		line        string
+		wantBlock   string
+		wantAllow   string
+		wantNeither bool
+	}{
+		{name: "basic rule", line: "||ads.example.com^", wantBlock: "ads.example.com"},
+		{name: "plain domain rule", line: "ads.example.com", wantBlock: "ads.example.com"},
+		{name: "exception rule", line: "@@||ads.example.com^", wantAllow: "ads.example.com"},
+		{name: "comment is ignored", line: "! comment", wantNeither: true},
+		{name: "cosmetic rule is ignored", line: "example.com##.ad-banner", wantNeither: true},
+		{name: "regex rule is ignored", line: "/ads\\d+/", wantNeither: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			names, allow := newDomainSet(), newDomainSet()
+			var c formatCounters
+			parseAdblockLine(tc.line, &names, &allow, &c)
+
+			switch {
+			case tc.wantBlock != "":
+				if !names.Match(tc.wantBlock) {
+					t.Errorf("expected %q to be blocked, names = %v", tc.wantBlock, names)
+				}
+			case tc.wantAllow != "":
+				if !allow.Match(tc.wantAllow) {
+					t.Errorf("expected %q to be allowed, allow = %v", tc.wantAllow, allow)
+				}
+			case tc.wantNeither:
+				if names.Len() != 0 || allow.Len() != 0 {
+					t.Errorf("expected neither set to gain an entry, names = %v allow = %v", names, allow)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRPZLine(t *testing.T) {
+	cases := []struct {
+		name      string
+		line      string
+		wantBlock string
+		wantSkip  bool
+	}{
+		{name: "NXDOMAIN policy", line: "bad.example.com CNAME .", wantBlock: "bad.example.com"},
+		{name: "trailing dot on owner name is stripped", line: "bad.example.org. CNAME .", wantBlock: "bad.example.org"},
+		{name: "rpz-passthru isn't a block", line: "ok.example.com CNAME rpz-passthru.", wantSkip: true},
+		{name: "too few fields", line: "bad.example.com CNAME", wantSkip: true},
+		{name: "comment is stripped before parsing", line: "bad.example.com CNAME . ; a comment", wantBlock: "bad.example.com"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			names := newDomainSet()
+			var c formatCounters
+			parseRPZLine(tc.line, &names, &c)
+
+			if tc.wantSkip {
+				if names.Len() != 0 {
+					t.Errorf("expected nothing to be added, names = %v", names)
+				}
+				return
+			}
+			if !names.Match(tc.wantBlock) {
+				t.Errorf("expected %q to be blocked, names = %v", tc.wantBlock, names)
+			}
+		})
+	}
+}
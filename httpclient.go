@@ -0,0 +1,39 @@
+package dnsredir
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// newHTTPClient builds the *http.Client used to fetch a URL-backed
+// Nameitem, honoring the Corefile `url_timeout`, `url_proxy` and
+// `tls_no_verify` directives. It returns http.DefaultClient when none of
+// them were set, so the common case allocates nothing extra
+func newHTTPClient(timeout time.Duration, proxyURL string, tlsNoVerify bool) (*http.Client, error) {
+	if timeout == 0 && proxyURL == "" && !tlsNoVerify {
+		return http.DefaultClient, nil
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if proxyURL != "" {
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	if tlsNoVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &http.Client{Transport: transport, Timeout: timeout}, nil
+}
+
+// basicAuthHeader returns the pre-built "Authorization" header value for
+// the Corefile `basic_auth` directive
+func basicAuthHeader(user, pass string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass))
+}
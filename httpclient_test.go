@@ -0,0 +1,36 @@
+package dnsredir
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	if c, err := newHTTPClient(0, "", false); err != nil || c != http.DefaultClient {
+		t.Errorf("newHTTPClient(0, \"\", false) = %v, %v, want http.DefaultClient, nil", c, err)
+	}
+
+	c, err := newHTTPClient(5*time.Second, "", false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c == http.DefaultClient {
+		t.Errorf("a non-zero timeout must not reuse http.DefaultClient")
+	}
+	if c.Timeout != 5*time.Second {
+		t.Errorf("Timeout = %v, want 5s", c.Timeout)
+	}
+
+	if _, err := newHTTPClient(0, "://not-a-url", false); err == nil {
+		t.Errorf("expected an error for an invalid url_proxy, got nil")
+	}
+}
+
+func TestBasicAuthHeader(t *testing.T) {
+	got := basicAuthHeader("user", "pass")
+	const want = "Basic dXNlcjpwYXNz"
+	if got != want {
+		t.Errorf("basicAuthHeader(\"user\", \"pass\") = %q, want %q", got, want)
+	}
+}
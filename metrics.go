@@ -0,0 +1,81 @@
+package dnsredir
+
+import (
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsSubsystem is shared by every collector the namelist subsystem
+// exposes, under the plugin's existing dnsredir namespace
+const metricsSubsystem = "dnsredir"
+
+var (
+	// namelistEntries is the number of domains currently loaded from a
+	// namelist source
+	namelistEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "namelist_entries",
+		Help:      "Number of domains currently loaded from a namelist source.",
+	}, []string{"path"})
+
+	// namelistReloadDuration is how long a reload of a namelist source took
+	namelistReloadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "namelist_reload_duration_seconds",
+		Help:      "Histogram of the time it took to reload a namelist source.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"path", "result"})
+
+	// namelistReloadTotal counts reload attempts of a namelist source
+	namelistReloadTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "namelist_reload_total",
+		Help:      "Counter of namelist reload attempts.",
+	}, []string{"path", "result"})
+
+	// namelistLastReload is the timestamp of the last reload of a namelist source
+	namelistLastReload = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "namelist_last_reload_timestamp_seconds",
+		Help:      "Timestamp of the last reload of a namelist source.",
+	}, []string{"path"})
+
+	// namelistMatchTotal counts Namelist.Match lookups by result
+	namelistMatchTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: metricsSubsystem,
+		Name:      "namelist_match_total",
+		Help:      "Counter of Namelist.Match lookups by result.",
+	}, []string{"result"})
+)
+
+// RegisterMetrics registers the namelist subsystem's collectors with
+// CoreDNS's metrics plugin
+func RegisterMetrics(c *caddy.Controller) {
+	metrics.MustRegister(c,
+		namelistEntries,
+		namelistReloadDuration,
+		namelistReloadTotal,
+		namelistLastReload,
+		namelistMatchTotal,
+	)
+}
+
+// observeReload records a reload attempt's outcome and duration, and
+// updates the entry/last-reload gauges on success
+func observeReload(path string, result string, dur float64, entries uint64) {
+	namelistReloadDuration.WithLabelValues(path, result).Observe(dur)
+	namelistReloadTotal.WithLabelValues(path, result).Inc()
+	if result == "error" {
+		return
+	}
+	namelistEntries.WithLabelValues(path).Set(float64(entries))
+	namelistLastReload.WithLabelValues(path).SetToCurrentTime()
+}
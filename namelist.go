@@ -2,157 +2,87 @@ package dnsredir
 
 import (
 	"bufio"
-	"fmt"
-	"github.com/coredns/coredns/plugin"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 )
 
-type stringSet map[string]struct{}
-// uint16 used to store two ASCII characters
-type domainSet map[uint16]stringSet
-
-func (s *stringSet) Add(str string) {
-	(*s)[str] = struct{}{}
-}
-
-func (s *stringSet) Contains(str string) bool {
-	if s == nil {
-		return false
-	}
-	_, ok := (*s)[str]
-	return ok
-}
-
-func (d domainSet) String() string {
-	var sb strings.Builder
-	sb.WriteString(fmt.Sprintf("%T[", d))
-
-	var i uint64
-	n := d.Len()
-	for _, s := range d {
-		for name := range s {
-			sb.WriteString(name)
-			if i++; i != n {
-				sb.WriteString(", ")
-			}
-		}
-	}
-	sb.WriteString("]")
-
-	return sb.String()
-}
-
-// Return total number of domains in the domain set
-func (d *domainSet) Len() uint64 {
-	var n uint64
-	for _, s := range *d {
-		n += uint64(len(s))
-	}
-	return n
-}
-
-func domainToIndex(str string) uint16 {
-	n := len(str)
-	if n == 0 {
-		panic(fmt.Sprintf("Unexpected empty string?!"))
-	}
-	// Since we use two ASCII characters to present index
-	//	Insufficient length will padded with '-'
-	//	Since a valid domain segment will never begin with '-'
-	//	So it can maintain balance between buckets
-	if n == 1 {
-		return (uint16('-') << 8) | uint16(str[0])
-	}
-	return uint16((str[0] << 8) | str[1])
-}
-
-// Return true if name added successfully, false otherwise
-func (d *domainSet) Add(str string) bool {
-	// To reduce memory, we don't use full qualified name
-	if name, ok := stringToDomain(str); ok {
-		// To speed up name lookup, we utilized two-way hash
-		// The first one is the first two ASCII characters of the domain name
-		// The second one is the real domain set
-		// Which works somewhat like ordinary English dictionary lookup
-		s := (*d)[domainToIndex(name)]
-		if s == nil {
-			// MT-Unsafe: Initialize real domain set on demand
-			s = make(stringSet)
-			(*d)[domainToIndex(name)] = s
-		}
-		s.Add(name)
-		return true
-	}
-	return false
-}
-
-// for loop will exit in advance if f() return error
-func (d *domainSet) ForEachDomain(f func(name string) error) error {
-	for _, s := range *d {
-		for name := range s {
-			if err := f(name); err != nil {
-				return err
-			}
-		}
-	}
-	return nil
-}
-
-// Assume `child' is lower cased and without trailing dot
-func (d *domainSet) Match(child string) bool {
-	if len(child) == 0 {
-		panic(fmt.Sprintf("Why child is an empty string?!"))
-	}
-
-	for {
-		s := (*d)[domainToIndex(child)]
-		// Fast lookup for a full match
-		if s.Contains(child) {
-			return true
-		}
-
-		// Fallback to iterate the whole set
-		for parent := range s {
-			if plugin.Name(parent).Matches(child) {
-				return true
-			}
-		}
-
-		i := strings.Index(child, ".")
-		if i <= 0 {
-			break
-		}
-		child = child[i+1:]
-	}
-
-	return false
-}
-
 type Nameitem struct {
 	sync.RWMutex
 
 	// Domain name set for lookups
 	names domainSet
 
-	path string
+	// Exception entries: a domain matched here wins over names whenever
+	// it's at least as specific, punching a hole through a blocked parent
+	allow domainSet
+
+	// Extra allow entries injected via the Corefile `except' directive,
+	// independent of whatever the upstream source itself contains
+	exceptEntries []string
+
+	path  string
 	mtime time.Time
-	size int64
+	size  int64
+
+	// lastParsed is when parseNamelistCore last actually touched this
+	// item's file, used to debounce the ticker reload against a fsnotify
+	// reload that just fired for the same file (see debounceWindow). Only
+	// kept up to date while reload_watch is on
+	lastParsed time.Time
+
+	// Source format, sniffed from the file content unless an explicit
+	// `format' directive overrides it in the Corefile
+	format namelistFormat
+
+	// Restricts which source IPs count as blocking in a formatHosts source,
+	// set via the Corefile `hosts_block_ip' directive. Nil/empty means any
+	// IP blocks
+	hostsBlockIPs map[string]struct{}
+
+	// Set when path is an http:// or https:// URL rather than a local file
+	isURL bool
+
+	// ETag and Last-Modified reported by the remote server on the last
+	// successful fetch, sent back as If-None-Match / If-Modified-Since so
+	// unchanged lists are answered with a 304 instead of a full download
+	etag         string
+	lastModified string
+
+	// Directory used to persist a fetched body plus its validators, so a
+	// restart doesn't force a re-download. Empty disables on-disk caching
+	cacheDir string
+
+	// Per-URL HTTP client, configured from the Corefile (timeout, proxy,
+	// TLS verification). basicAuth is a pre-built "Basic <base64>" value
+	httpClient *http.Client
+	basicAuth  string
 }
 
 func NewNameitemsWithPaths(paths []string) []*Nameitem {
 	items := make([]*Nameitem, len(paths))
 	for i, path := range paths {
 		items[i] = &Nameitem{
-			path: path,
+			path:  path,
+			isURL: isHTTPURL(path),
 		}
 	}
 	return items
 }
 
+// Return true if path looks like an http(s) URL rather than a local file path
+func isHTTPURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
 type Namelist struct {
 	// List of name items
 	items []*Nameitem
@@ -161,6 +91,10 @@ type Namelist struct {
 	// All name items shared the same reload duration
 	reload time.Duration
 
+	// Watch file-backed items with fsnotify and reload them as soon as
+	// they change, instead of waiting for the next reload tick
+	reloadWatch bool
+
 	stopReload chan struct{}
 }
 
@@ -168,20 +102,40 @@ type Namelist struct {
 func (n *Namelist) Match(child string) bool {
 	for _, item := range n.items {
 		item.RLock()
-		if item.names.Match(child) {
-			item.RUnlock()
+		blocked := item.match(child)
+		item.RUnlock()
+		if blocked {
+			namelistMatchTotal.WithLabelValues("hit").Inc()
 			return true
 		}
-		item.RUnlock()
 	}
+	namelistMatchTotal.WithLabelValues("miss").Inc()
 	return false
 }
 
+// match reports whether child is blocked by this item's names set. Longest
+// suffix wins between names and allow: an allow entry only punches through
+// when it's at least as specific as the blocking entry it overrides
+func (item *Nameitem) match(child string) bool {
+	blockDepth := item.names.matchDepth(child)
+	if blockDepth == 0 {
+		return false
+	}
+	return item.allow.matchDepth(child) < blockDepth
+}
+
 // MT-Unsafe
 func (n *Namelist) periodicUpdate() {
 	// Kick off initial name list content population
 	n.parseNamelist()
 
+	if n.reloadWatch {
+		n.startWatch()
+	}
+
+	// The ticker still runs even when reloadWatch is on: it's the only
+	// reload path for URL-backed items, and a fallback on filesystems
+	// without usable inotify semantics
 	if n.reload != 0 {
 		go func() {
 			ticker := time.NewTicker(n.reload)
@@ -204,6 +158,33 @@ func (n *Namelist) parseNamelist() {
 }
 
 func (n *Namelist) parseNamelistCore(item *Nameitem) {
+	if item.isURL {
+		n.parseNamelistURL(item)
+		return
+	}
+
+	// With reload_watch on, a ticker reload and a fsnotify-debounced reload
+	// can both land on the same file-backed item within the same
+	// debounceWindow; only let the first one through so a burst doesn't
+	// stat+parse the file twice. Plain ticker-only reloads never race
+	// anything, so they're left alone regardless of how short `reload' is
+	if n.reloadWatch {
+		item.Lock()
+		since := time.Since(item.lastParsed)
+		debounced := !item.lastParsed.IsZero() && since < debounceWindow
+		if !debounced {
+			item.lastParsed = time.Now()
+		}
+		entries := item.names.Len()
+		item.Unlock()
+
+		if debounced {
+			log.Debugf("%v: reload skipped, parsed %v ago", item.path, since)
+			observeReload(item.path, "debounced", 0, entries)
+			return
+		}
+	}
+
 	file, err := os.Open(item.path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -212,6 +193,7 @@ func (n *Namelist) parseNamelistCore(item *Nameitem) {
 		} else {
 			log.Warningf("%v", err)
 		}
+		observeReload(item.path, "error", 0, 0)
 		return
 	}
 	defer Close(file)
@@ -221,9 +203,11 @@ func (n *Namelist) parseNamelistCore(item *Nameitem) {
 		item.RLock()
 		mtime := item.mtime
 		size := item.size
+		entries := item.names.Len()
 		item.RUnlock()
 
 		if stat.ModTime() == mtime && stat.Size() == size {
+			observeReload(item.path, "unchanged", 0, entries)
 			return
 		}
 	} else {
@@ -232,51 +216,226 @@ func (n *Namelist) parseNamelistCore(item *Nameitem) {
 	}
 
 	t1 := time.Now()
-	names, totalLines := n.parse(file)
+	names, allow, totalLines := n.parse(file, item.format, item.hostsBlockIPs)
 	t2 := time.Since(t1)
 	log.Debugf("Parsed %v  time spent: %v name added: %v / %v",
 		file.Name(), t2, names.Len(), totalLines)
 
+	item.applyExceptEntries(&allow)
+
 	item.Lock()
 	item.names = names
+	item.allow = allow
 	item.mtime = stat.ModTime()
 	item.size = stat.Size()
 	item.Unlock()
+
+	observeReload(item.path, "ok", t2.Seconds(), names.Len())
 }
 
-func (n *Namelist) parse(r io.Reader) (domainSet, uint64) {
-	names := make(domainSet)
+// applyExceptEntries merges the Corefile `except' directive's domains into
+// allow, independent of whatever the upstream source itself contains
+func (item *Nameitem) applyExceptEntries(allow *domainSet) {
+	for _, e := range item.exceptEntries {
+		if !allow.Add(e) {
+			log.Warningf("%q isn't a domain name", e)
+		}
+	}
+}
 
-	var totalLines uint64
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		totalLines++
+// Fetch an http(s)-backed Nameitem with a conditional GET, falling back to
+// the on-disk cache on the very first load if the remote is unreachable.
+// A failed or 304 fetch leaves item.names untouched.
+func (n *Namelist) parseNamelistURL(item *Nameitem) {
+	item.RLock()
+	etag := item.etag
+	lastModified := item.lastModified
+	loaded := item.names.root != nil
+	item.RUnlock()
+
+	req, err := http.NewRequest(http.MethodGet, item.path, nil)
+	if err != nil {
+		log.Warningf("%v", err)
+		observeReload(item.path, "error", 0, 0)
+		return
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	if item.basicAuth != "" {
+		req.Header.Set("Authorization", item.basicAuth)
+	}
 
-		line := scanner.Text()
-		if i := strings.IndexByte(line, '#'); i >= 0 {
-			line = line[:i]
-		}
+	client := item.httpClient
+	if client == nil {
+		client = http.DefaultClient
+	}
 
-		f := strings.Split(line, "/")
-		if len(f) != 3 {
-			// Treat the whole line as a domain name
-			_ = names.Add(line)
-			continue
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Warningf("%v", err)
+		observeReload(item.path, "error", 0, 0)
+		if !loaded {
+			n.loadCachedNamelist(item)
 		}
+		return
+	}
+	defer Close(resp.Body)
 
-		// Format: server=/<domain>/<?>
-		if f[0] != "server=" {
-			continue
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		log.Debugf("%v not modified", item.path)
+		item.RLock()
+		entries := item.names.Len()
+		item.RUnlock()
+		observeReload(item.path, "unchanged", 0, entries)
+		return
+	case http.StatusOK:
+		// Fall through and (re-)parse the body below
+	default:
+		log.Warningf("%v: unexpected status %v", item.path, resp.Status)
+		observeReload(item.path, "error", 0, 0)
+		if !loaded {
+			n.loadCachedNamelist(item)
 		}
+		return
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Warningf("%v", err)
+		observeReload(item.path, "error", 0, 0)
+		return
+	}
+
+	t1 := time.Now()
+	names, allow, totalLines := n.parse(bytes.NewReader(body), item.format, item.hostsBlockIPs)
+	t2 := time.Since(t1)
+	log.Debugf("Fetched %v  time spent: %v name added: %v / %v",
+		item.path, t2, names.Len(), totalLines)
+
+	item.applyExceptEntries(&allow)
+
+	item.Lock()
+	item.names = names
+	item.allow = allow
+	item.etag = resp.Header.Get("ETag")
+	item.lastModified = resp.Header.Get("Last-Modified")
+	item.Unlock()
+
+	n.cacheNamelistBody(item, body)
+
+	observeReload(item.path, "ok", t2.Seconds(), names.Len())
+}
+
+// cacheFilePath returns the on-disk cache path for an URL-backed Nameitem,
+// keyed by the SHA-256 of its URL so arbitrary paths/queries are filesystem-safe
+func cacheFilePath(cacheDir, url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(cacheDir, hex.EncodeToString(sum[:])+".cache")
+}
+
+// Persist a freshly fetched body plus its validators so a restart doesn't
+// force a re-download
+func (n *Namelist) cacheNamelistBody(item *Nameitem, body []byte) {
+	if item.cacheDir == "" {
+		return
+	}
+	if err := os.MkdirAll(item.cacheDir, 0755); err != nil {
+		log.Warningf("%v", err)
+		return
+	}
 
-		// Don't check f[2], see: http://manpages.ubuntu.com/manpages/bionic/man8/dnsmasq.8.html
-		// Thus server=/<domain>/<ip>, server=/<domain>/, server=/<domain>/# won't be honored
+	p := cacheFilePath(item.cacheDir, item.path)
+	if err := ioutil.WriteFile(p, body, 0644); err != nil {
+		log.Warningf("%v", err)
+		return
+	}
+
+	item.RLock()
+	meta := item.etag + "\n" + item.lastModified + "\n"
+	item.RUnlock()
+	if err := ioutil.WriteFile(p+".meta", []byte(meta), 0644); err != nil {
+		log.Warningf("%v", err)
+	}
+}
+
+// Load a previously cached body (and its validators) from disk, used when
+// the remote is unreachable on the very first fetch after a restart
+func (n *Namelist) loadCachedNamelist(item *Nameitem) {
+	if item.cacheDir == "" {
+		return
+	}
+
+	p := cacheFilePath(item.cacheDir, item.path)
+	body, err := ioutil.ReadFile(p)
+	if err != nil {
+		return
+	}
 
-		if !names.Add(f[1]) {
-			log.Warningf("%q isn't a domain name", f[1])
+	if meta, err := ioutil.ReadFile(p + ".meta"); err == nil {
+		lines := strings.SplitN(string(meta), "\n", 3)
+		if len(lines) >= 2 {
+			item.Lock()
+			item.etag = lines[0]
+			item.lastModified = lines[1]
+			item.Unlock()
 		}
 	}
 
-	return names, totalLines
+	names, allow, totalLines := n.parse(bytes.NewReader(body), item.format, item.hostsBlockIPs)
+	log.Debugf("Loaded cached copy of %v  name added: %v / %v", item.path, names.Len(), totalLines)
+
+	item.applyExceptEntries(&allow)
+
+	item.Lock()
+	item.names = names
+	item.allow = allow
+	item.Unlock()
 }
 
+// parse reads r line by line into a block set (plus any allow/exception
+// entries recognized along the way) and returns them with the number of
+// lines read. When format is formatAuto, the concrete format is sniffed
+// from the first non-comment, non-blank line and used for the rest of r.
+// hostsBlockIPs is only consulted for formatHosts sources
+func (n *Namelist) parse(r io.Reader, format namelistFormat, hostsBlockIPs map[string]struct{}) (domainSet, domainSet, uint64) {
+	names := newDomainSet()
+	allow := newDomainSet()
+	var counters formatCounters
+
+	sniffed := format != formatAuto
+	var totalLines uint64
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		totalLines++
+		line := scanner.Text()
+
+		if !sniffed {
+			if s := strings.TrimSpace(line); s != "" && !isCommentLine(s) {
+				format = sniffFormat(s)
+				sniffed = true
+			}
+		}
+
+		switch format {
+		case formatHosts:
+			parseHostsLine(line, &names, hostsBlockIPs, &counters)
+		case formatAdblock:
+			parseAdblockLine(line, &names, &allow, &counters)
+		case formatRPZ:
+			parseRPZLine(line, &names, &counters)
+		default:
+			// formatDnsmasq and formatDomains share a parser: a dnsmasq
+			// list is just a domain list with the occasional server=/.../ line
+			parseDnsmasqOrDomainsLine(line, &names, &allow, &counters)
+		}
+	}
+
+	log.Debugf("%v: %+v", format, counters)
+
+	return names, allow, totalLines
+}
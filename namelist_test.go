@@ -0,0 +1,138 @@
+package dnsredir
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// TestParseNamelistCoreDebouncesBurstReloads verifies that a second
+// parseNamelistCore call landing within debounceWindow of the first is
+// skipped instead of re-stat'ing and re-parsing the same file, which is
+// what happens when a ticker reload and a fsnotify reload race each other
+func TestParseNamelistCoreDebouncesBurstReloads(t *testing.T) {
+	f, err := ioutil.TempFile("", "dnsredir-namelist")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("ads.example.com\n"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	f.Close()
+
+	item := &Nameitem{path: f.Name()}
+	n := &Namelist{items: []*Nameitem{item}, reloadWatch: true}
+
+	n.parseNamelistCore(item)
+	if !item.names.Match("ads.example.com") {
+		t.Fatalf("expected ads.example.com to be blocked after the first parse")
+	}
+	firstParsed := item.lastParsed
+
+	n.parseNamelistCore(item)
+	if item.lastParsed != firstParsed {
+		t.Errorf("a reload within debounceWindow must be skipped, but lastParsed advanced")
+	}
+}
+
+// TestParseNamelistCoreSkipsDebounceWithoutReloadWatch verifies that the
+// debounce guard is a no-op when reload_watch is off, so a short `reload'
+// interval is never silently throttled by it
+func TestParseNamelistCoreSkipsDebounceWithoutReloadWatch(t *testing.T) {
+	f, err := ioutil.TempFile("", "dnsredir-namelist")
+	if err != nil {
+		t.Fatalf("TempFile: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("ads.example.com\n"); err != nil {
+		t.Fatalf("WriteString: %v", err)
+	}
+	f.Close()
+
+	item := &Nameitem{path: f.Name()}
+	n := &Namelist{items: []*Nameitem{item}}
+
+	n.parseNamelistCore(item)
+	if !item.lastParsed.IsZero() {
+		t.Fatalf("lastParsed should stay untouched when reload_watch is off")
+	}
+
+	// Touch the file so the mtime/size shortcut doesn't itself skip the
+	// second parse, then make sure the (disabled) debounce guard doesn't
+	// either
+	if err := ioutil.WriteFile(f.Name(), []byte("ads.example.com\nmore.example.com\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	n.parseNamelistCore(item)
+	if !item.names.Match("more.example.com") {
+		t.Errorf("a reload right after the first one must not be debounced when reload_watch is off")
+	}
+}
+
+// TestNameitemMatch pins down the longest-suffix-wins tie-breaking rule
+// between a blocked names set and its allow/exception set
+func TestNameitemMatch(t *testing.T) {
+	newItem := func(blocked, allowed []string) *Nameitem {
+		item := &Nameitem{names: newDomainSet(), allow: newDomainSet()}
+		for _, d := range blocked {
+			item.names.Add(d)
+		}
+		for _, d := range allowed {
+			item.allow.Add(d)
+		}
+		return item
+	}
+
+	cases := []struct {
+		name    string
+		item    *Nameitem
+		child   string
+		blocked bool
+	}{
+		{
+			name:    "not blocked at all",
+			item:    newItem([]string{"example.com"}, nil),
+			child:   "example.org",
+			blocked: false,
+		},
+		{
+			name:    "blocked parent, no allow entry",
+			item:    newItem([]string{"example.com"}, nil),
+			child:   "sub.example.com",
+			blocked: true,
+		},
+		{
+			name:    "allow entry punches through a more specific leaf under a blocked parent",
+			item:    newItem([]string{"example.com"}, []string{"allowed.example.com"}),
+			child:   "allowed.example.com",
+			blocked: false,
+		},
+		{
+			name:    "the same blocked parent still blocks siblings of the allowed leaf",
+			item:    newItem([]string{"example.com"}, []string{"allowed.example.com"}),
+			child:   "other.example.com",
+			blocked: true,
+		},
+		{
+			name:    "a more specific block entry wins over a less specific allow entry",
+			item:    newItem([]string{"bad.example.com"}, []string{"example.com"}),
+			child:   "bad.example.com",
+			blocked: true,
+		},
+		{
+			name:    "a tie between names and allow at the same depth favors allow",
+			item:    newItem([]string{"example.com"}, []string{"example.com"}),
+			child:   "example.com",
+			blocked: false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.item.match(tc.child); got != tc.blocked {
+				t.Errorf("match(%q) = %v, want %v", tc.child, got, tc.blocked)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package dnsredir
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseNamelistURLFetchAndConditionalGet(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("ads.example.com\n"))
+	}))
+	defer srv.Close()
+
+	item := &Nameitem{path: srv.URL, isURL: true}
+	n := &Namelist{items: []*Nameitem{item}}
+
+	n.parseNamelistURL(item)
+	if !item.names.Match("ads.example.com") {
+		t.Fatalf("expected ads.example.com to be blocked after first fetch, names = %v", item.names)
+	}
+	if item.etag != `"v1"` {
+		t.Fatalf("etag = %q, want %q", item.etag, `"v1"`)
+	}
+
+	n.parseNamelistURL(item)
+	if got := atomic.LoadInt32(&hits); got != 2 {
+		t.Fatalf("server was hit %v times, want 2", got)
+	}
+	if !item.names.Match("ads.example.com") {
+		t.Errorf("a 304 response must leave the previously parsed names alone")
+	}
+}
+
+func TestParseNamelistURLBasicAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != basicAuthHeader("user", "pass") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("ads.example.com\n"))
+	}))
+	defer srv.Close()
+
+	item := &Nameitem{path: srv.URL, isURL: true, basicAuth: basicAuthHeader("user", "pass")}
+	n := &Namelist{items: []*Nameitem{item}}
+
+	n.parseNamelistURL(item)
+	if !item.names.Match("ads.example.com") {
+		t.Fatalf("expected ads.example.com to be blocked, names = %v", item.names)
+	}
+}
+
+func TestCacheNamelistBodyAndLoadCachedNamelist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsredir-cache")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	item := &Nameitem{path: "https://example.com/list.txt", isURL: true, cacheDir: dir}
+	item.etag = `"v1"`
+	n := &Namelist{items: []*Nameitem{item}}
+
+	body := []byte("ads.example.com\n")
+	n.cacheNamelistBody(item, body)
+
+	p := cacheFilePath(dir, item.path)
+	if _, err := os.Stat(p); err != nil {
+		t.Fatalf("expected a cache file at %v: %v", p, err)
+	}
+	if _, err := os.Stat(p + ".meta"); err != nil {
+		t.Fatalf("expected a cache metadata file at %v: %v", p+".meta", err)
+	}
+
+	// A fresh item, as if after a restart: loadCachedNamelist should
+	// repopulate both the names set and the cached validators
+	fresh := &Nameitem{path: item.path, isURL: true, cacheDir: dir}
+	n2 := &Namelist{items: []*Nameitem{fresh}}
+	n2.loadCachedNamelist(fresh)
+
+	if !fresh.names.Match("ads.example.com") {
+		t.Errorf("expected ads.example.com to be loaded from cache, names = %v", fresh.names)
+	}
+	if fresh.etag != `"v1"` {
+		t.Errorf("etag = %q, want %q (restored from cache metadata)", fresh.etag, `"v1"`)
+	}
+}
+
+func TestCacheFilePathIsFilesystemSafe(t *testing.T) {
+	p := cacheFilePath("/tmp/cache", "https://example.com/a/b?c=d&e=f")
+	if filepath.Dir(p) != "/tmp/cache" {
+		t.Errorf("cacheFilePath should live under the configured cacheDir, got %q", p)
+	}
+	if filepath.Base(p) == "" || filepath.Ext(p) != ".cache" {
+		t.Errorf("unexpected cache file name: %q", p)
+	}
+}
@@ -0,0 +1,99 @@
+package dnsredir
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// debounceWindow coalesces bursts of events against the same file, e.g.
+// editors that write a temp file then rename it over the original
+const debounceWindow = 200 * time.Millisecond
+
+// startWatch spawns a single fsnotify watcher over the parent directories
+// of all file-backed Nameitem.path, reloading an item as soon as its file
+// changes instead of waiting for the next reload tick. We watch directories
+// rather than the files themselves so that editors which replace a file by
+// rename-over (leaving the original inode removed) are picked up without
+// having to detect the removal and re-add a watch
+func (n *Namelist) startWatch() {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warningf("%v", err)
+		return
+	}
+
+	dirs := make(map[string]struct{})
+	for _, item := range n.items {
+		if item.isURL {
+			continue
+		}
+		dir := filepath.Dir(item.path)
+		if _, ok := dirs[dir]; ok {
+			continue
+		}
+		if err := w.Add(dir); err != nil {
+			log.Warningf("%v", err)
+			continue
+		}
+		dirs[dir] = struct{}{}
+	}
+
+	go n.watchLoop(w)
+}
+
+func (n *Namelist) watchLoop(w *fsnotify.Watcher) {
+	defer Close(w)
+
+	var mu sync.Mutex
+	pending := make(map[string]*time.Timer)
+
+	debounce := func(path string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if t, ok := pending[path]; ok {
+			t.Stop()
+		}
+		pending[path] = time.AfterFunc(debounceWindow, func() {
+			mu.Lock()
+			delete(pending, path)
+			mu.Unlock()
+			n.reloadWatchedPath(path)
+		})
+	}
+
+	for {
+		select {
+		case <-n.stopReload:
+			return
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			debounce(event.Name)
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Warningf("%v", err)
+		}
+	}
+}
+
+// reloadWatchedPath reloads every file-backed Nameitem whose path matches
+// the file that just triggered an fsnotify event
+func (n *Namelist) reloadWatchedPath(path string) {
+	for _, item := range n.items {
+		if item.isURL {
+			continue
+		}
+		if filepath.Clean(item.path) == filepath.Clean(path) {
+			n.parseNamelistCore(item)
+		}
+	}
+}
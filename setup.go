@@ -0,0 +1,208 @@
+package dnsredir
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/plugin"
+)
+
+func init() { plugin.Register("dnsredir", setup) }
+
+func setup(c *caddy.Controller) error {
+	n, err := namelistParse(c)
+	if err != nil {
+		return plugin.Error("dnsredir", err)
+	}
+
+	RegisterMetrics(c)
+
+	c.OnStartup(func() error {
+		n.periodicUpdate()
+		return nil
+	})
+	c.OnShutdown(func() error {
+		close(n.stopReload)
+		return nil
+	})
+
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		return &Dnsredir{Next: next, Namelist: n}
+	})
+
+	return nil
+}
+
+// namelistParse builds a Namelist out of one or more `dnsredir <path...> { }`
+// blocks. reload and reload_watch are stored on the Namelist, so they apply
+// to the paths of every block and a later block's value overrides an earlier
+// one; the other directives apply only to the paths of their own block
+func namelistParse(c *caddy.Controller) (*Namelist, error) {
+	n := &Namelist{stopReload: make(chan struct{})}
+
+	for c.Next() {
+		paths := c.RemainingArgs()
+		if len(paths) == 0 {
+			return nil, c.ArgErr()
+		}
+		items := NewNameitemsWithPaths(paths)
+
+		var (
+			cacheDir      string
+			urlTimeout    time.Duration
+			urlProxy      string
+			tlsNoVerify   bool
+			basicAuthUser string
+			basicAuthPass string
+			format        = formatAuto
+			exceptEntries []string
+			hostsBlockIPs map[string]struct{}
+		)
+
+		for c.NextBlock() {
+			switch c.Val() {
+			case "hosts_block_ip":
+				remaining := c.RemainingArgs()
+				if len(remaining) == 0 {
+					return nil, c.Errf("hosts_block_ip needs at least one IP")
+				}
+				if hostsBlockIPs == nil {
+					hostsBlockIPs = make(map[string]struct{}, len(remaining))
+				}
+				for _, s := range remaining {
+					ip := net.ParseIP(s)
+					if ip == nil {
+						return nil, c.Errf("hosts_block_ip: %q isn't an IP address", s)
+					}
+					hostsBlockIPs[ip.String()] = struct{}{}
+				}
+			case "except":
+				remaining := c.RemainingArgs()
+				if len(remaining) == 0 {
+					return nil, c.Errf("except needs at least one domain")
+				}
+				exceptEntries = append(exceptEntries, remaining...)
+			case "format":
+				remaining := c.RemainingArgs()
+				if len(remaining) != 1 {
+					return nil, c.Errf("format needs exactly one of: auto, domains, dnsmasq, hosts, adblock, rpz")
+				}
+				f, err := ParseNamelistFormat(remaining[0])
+				if err != nil {
+					return nil, c.Err(err.Error())
+				}
+				format = f
+			case "cache_dir":
+				remaining := c.RemainingArgs()
+				if len(remaining) != 1 {
+					return nil, c.Errf("cache_dir needs a directory")
+				}
+				cacheDir = remaining[0]
+			case "url_timeout":
+				remaining := c.RemainingArgs()
+				if len(remaining) != 1 {
+					return nil, c.Errf("url_timeout needs a duration")
+				}
+				d, err := time.ParseDuration(remaining[0])
+				if err != nil {
+					return nil, c.Errf("invalid duration for url_timeout '%s'", remaining[0])
+				}
+				urlTimeout = d
+			case "url_proxy":
+				remaining := c.RemainingArgs()
+				if len(remaining) != 1 {
+					return nil, c.Errf("url_proxy needs a proxy URL")
+				}
+				urlProxy = remaining[0]
+			case "tls_no_verify":
+				tlsNoVerify = true
+			case "basic_auth":
+				remaining := c.RemainingArgs()
+				if len(remaining) != 2 {
+					return nil, c.Errf("basic_auth needs a username and a password")
+				}
+				basicAuthUser, basicAuthPass = remaining[0], remaining[1]
+			case "reload":
+				remaining := c.RemainingArgs()
+				if len(remaining) != 1 {
+					return nil, c.Errf("reload needs a duration (zero to disable)")
+				}
+				reload, err := time.ParseDuration(remaining[0])
+				if err != nil {
+					return nil, c.Errf("invalid duration for reload '%s'", remaining[0])
+				}
+				if reload < 0 {
+					return nil, c.Errf("invalid negative duration for reload '%s'", remaining[0])
+				}
+				n.reload = reload
+			case "reload_watch":
+				remaining := c.RemainingArgs()
+				if len(remaining) > 1 {
+					return nil, c.ArgErr()
+				}
+				watch := true
+				if len(remaining) == 1 {
+					b, err := strconv.ParseBool(remaining[0])
+					if err != nil {
+						return nil, c.Errf("reload_watch needs a boolean: %v", err)
+					}
+					watch = b
+				}
+				n.reloadWatch = watch
+			default:
+				return nil, c.Errf("unknown property %q", c.Val())
+			}
+		}
+
+		if format != formatAuto {
+			for _, item := range items {
+				item.format = format
+			}
+		}
+
+		if len(exceptEntries) > 0 {
+			for _, item := range items {
+				item.exceptEntries = append(item.exceptEntries, exceptEntries...)
+			}
+		}
+
+		if len(hostsBlockIPs) > 0 {
+			for _, item := range items {
+				item.hostsBlockIPs = hostsBlockIPs
+			}
+		}
+
+		if cacheDir != "" || urlTimeout != 0 || urlProxy != "" || tlsNoVerify || basicAuthUser != "" {
+			client, err := newHTTPClient(urlTimeout, urlProxy, tlsNoVerify)
+			if err != nil {
+				return nil, c.Errf("invalid url_proxy '%s': %v", urlProxy, err)
+			}
+
+			var basicAuth string
+			if basicAuthUser != "" {
+				basicAuth = basicAuthHeader(basicAuthUser, basicAuthPass)
+			}
+
+			applied := false
+			for _, item := range items {
+				if !item.isURL {
+					continue
+				}
+				item.cacheDir = cacheDir
+				item.httpClient = client
+				item.basicAuth = basicAuth
+				applied = true
+			}
+			if !applied {
+				log.Warningf("cache_dir/url_timeout/url_proxy/tls_no_verify/basic_auth set on %v, which has no http(s):// paths; ignored", paths)
+			}
+		}
+
+		n.items = append(n.items, items...)
+	}
+
+	return n, nil
+}
@@ -0,0 +1,233 @@
+package dnsredir
+
+import (
+	"fmt"
+	"strings"
+)
+
+// domainSet is a suffix-matching set of domain names. It's a trie keyed by
+// labels in reverse order(e.g. "www.example.com" is stored as
+// com -> example -> www), so matching a query walks the trie from the TLD
+// inward along the query's labels and records the deepest node on that path
+// that terminates a blocked suffix. Zero value is an empty, usable set.
+type domainSet struct {
+	root *trieNode
+	n    uint64
+}
+
+// childMapThreshold is the fanout at which a node promotes its children
+// from a sorted slice to a map. Most nodes only ever hold a handful of
+// children, where a linear/binary scan beats the overhead of a map, but
+// some (e.g. a TLD node in a multi-million-entry blocklist) fan out into
+// hundreds of thousands of siblings, where the O(n) slice insert turns
+// building the trie into an O(n²) operation
+const childMapThreshold = 32
+
+// trieNode is one label of a domain name. Children start out in a small
+// sorted slice; once a node's fanout crosses childMapThreshold they're
+// migrated to childMap once and for all
+type trieNode struct {
+	label    string
+	children []*trieNode
+	childMap map[string]*trieNode
+	// terminal marks this node as the end of a blocked suffix, i.e. this
+	// label and everything below it matches
+	terminal bool
+}
+
+func newDomainSet() domainSet {
+	return domainSet{root: &trieNode{}}
+}
+
+// search returns the index of label in t.children, and whether it was found.
+// When not found, the index is where label should be inserted to keep the
+// slice sorted
+func (t *trieNode) search(label string) (int, bool) {
+	lo, hi := 0, len(t.children)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if t.children[mid].label < label {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, lo < len(t.children) && t.children[lo].label == label
+}
+
+func (t *trieNode) find(label string) *trieNode {
+	if t.childMap != nil {
+		return t.childMap[label]
+	}
+	if i, ok := t.search(label); ok {
+		return t.children[i]
+	}
+	return nil
+}
+
+func (t *trieNode) getOrCreate(label string) *trieNode {
+	if t.childMap != nil {
+		child, ok := t.childMap[label]
+		if !ok {
+			child = &trieNode{label: label}
+			t.childMap[label] = child
+		}
+		return child
+	}
+
+	i, ok := t.search(label)
+	if ok {
+		return t.children[i]
+	}
+
+	if len(t.children) >= childMapThreshold {
+		t.promoteToMap()
+		child := &trieNode{label: label}
+		t.childMap[label] = child
+		return child
+	}
+
+	child := &trieNode{label: label}
+	t.children = append(t.children, nil)
+	copy(t.children[i+1:], t.children[i:])
+	t.children[i] = child
+	return child
+}
+
+// promoteToMap migrates an already-sorted children slice to childMap,
+// freeing the slice since it won't be maintained once the map takes over
+func (t *trieNode) promoteToMap() {
+	t.childMap = make(map[string]*trieNode, len(t.children)+1)
+	for _, child := range t.children {
+		t.childMap[child.label] = child
+	}
+	t.children = nil
+}
+
+// eachChild calls f for every child, regardless of whether they're
+// currently held in the slice or the map
+func (t *trieNode) eachChild(f func(*trieNode) error) error {
+	if t.childMap != nil {
+		for _, child := range t.childMap {
+			if err := f(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, child := range t.children {
+		if err := f(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return total number of domains in the domain set
+func (d *domainSet) Len() uint64 {
+	return d.n
+}
+
+// Return true if name added successfully, false otherwise
+func (d *domainSet) Add(str string) bool {
+	// To reduce memory, we don't use full qualified name
+	name, ok := stringToDomain(str)
+	if !ok {
+		return false
+	}
+
+	if d.root == nil {
+		d.root = &trieNode{}
+	}
+
+	labels := strings.Split(name, ".")
+	node := d.root
+	for i := len(labels) - 1; i >= 0; i-- {
+		node = node.getOrCreate(labels[i])
+	}
+
+	if !node.terminal {
+		node.terminal = true
+		d.n++
+	}
+	return true
+}
+
+// for loop will exit in advance if f() return error
+func (d *domainSet) ForEachDomain(f func(name string) error) error {
+	if d.root == nil {
+		return nil
+	}
+	return d.root.forEachDomain(nil, f)
+}
+
+// labels are kept TLD-first, matching how they're stored in the trie
+func (t *trieNode) forEachDomain(labels []string, f func(name string) error) error {
+	if t.terminal {
+		rev := make([]string, len(labels))
+		for i, label := range labels {
+			rev[len(labels)-1-i] = label
+		}
+		if err := f(strings.Join(rev, ".")); err != nil {
+			return err
+		}
+	}
+
+	return t.eachChild(func(child *trieNode) error {
+		next := make([]string, len(labels)+1)
+		copy(next, labels)
+		next[len(labels)] = child.label
+		return child.forEachDomain(next, f)
+	})
+}
+
+// Assume `child' is lower cased and without trailing dot
+func (d *domainSet) Match(child string) bool {
+	return d.matchDepth(child) > 0
+}
+
+// matchDepth returns the number of labels in the longest suffix of child
+// that terminates a blocked entry, or 0 if none does. It's the primitive
+// behind Match, and lets callers compare specificity between two domainSet
+// (e.g. a block set and an allow set) to decide which one wins
+func (d *domainSet) matchDepth(child string) int {
+	if len(child) == 0 {
+		panic(fmt.Sprintf("Why child is an empty string?!"))
+	}
+	if d.root == nil {
+		return 0
+	}
+
+	labels := strings.Split(child, ".")
+	node := d.root
+	depth, longest := 0, 0
+	for i := len(labels) - 1; i >= 0; i-- {
+		node = node.find(labels[i])
+		if node == nil {
+			break
+		}
+		depth++
+		if node.terminal {
+			longest = depth
+		}
+	}
+	return longest
+}
+
+func (d domainSet) String() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%T[", d))
+
+	first := true
+	_ = d.ForEachDomain(func(name string) error {
+		if !first {
+			sb.WriteString(", ")
+		}
+		first = false
+		sb.WriteString(name)
+		return nil
+	})
+	sb.WriteString("]")
+
+	return sb.String()
+}
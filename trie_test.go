@@ -0,0 +1,110 @@
+package dnsredir
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestDomainSetAddDuplicate verifies that adding the same domain twice
+// doesn't double-count Len()
+func TestDomainSetAddDuplicate(t *testing.T) {
+	d := newDomainSet()
+	if !d.Add("example.com") {
+		t.Fatalf("Add(%q) = false, want true", "example.com")
+	}
+	if !d.Add("example.com") {
+		t.Fatalf("second Add(%q) = false, want true", "example.com")
+	}
+	if got := d.Len(); got != 1 {
+		t.Errorf("Len() = %v, want 1", got)
+	}
+}
+
+// TestDomainSetPathThroughNotTerminal verifies that a label node created
+// only as a path to a deeper terminal entry doesn't itself match, e.g.
+// adding "www.example.com" must not make "example.com" or "com" match
+func TestDomainSetPathThroughNotTerminal(t *testing.T) {
+	d := newDomainSet()
+	d.Add("www.example.com")
+
+	if d.Match("com") {
+		t.Errorf("Match(%q) = true, want false (path-through node, never terminal)", "com")
+	}
+	if d.Match("example.com") {
+		t.Errorf("Match(%q) = true, want false (path-through node, never terminal)", "example.com")
+	}
+	if !d.Match("www.example.com") {
+		t.Errorf("Match(%q) = false, want true", "www.example.com")
+	}
+	if !d.Match("sub.www.example.com") {
+		t.Errorf("Match(%q) = false, want true (suffix of a terminal entry)", "sub.www.example.com")
+	}
+}
+
+// TestDomainSetChildMapPromotion verifies that a node's children remain
+// correctly searchable across the slice->map promotion at childMapThreshold,
+// both for a child added before the promotion and one added after it
+func TestDomainSetChildMapPromotion(t *testing.T) {
+	d := newDomainSet()
+
+	n := childMapThreshold + 8
+	domain := func(i int) string { return fmt.Sprintf("n%d.example.com", i) }
+
+	for i := 0; i < n; i++ {
+		if !d.Add(domain(i)) {
+			t.Fatalf("Add(%q) = false, want true", domain(i))
+		}
+	}
+
+	if got := d.Len(); got != uint64(n) {
+		t.Fatalf("Len() = %v, want %v", got, n)
+	}
+
+	// Spot-check a child added before and one added after the promotion
+	if !d.Match(domain(0)) {
+		t.Errorf("Match(%q) = false, want true (added before promotion)", domain(0))
+	}
+	if !d.Match(domain(n - 1)) {
+		t.Errorf("Match(%q) = false, want true (added after promotion)", domain(n-1))
+	}
+	if d.Match(domain(n)) {
+		t.Errorf("Match(%q) = true, want false (never added)", domain(n))
+	}
+
+	node := d.root.find("com").find("example")
+	if node == nil || node.childMap == nil {
+		t.Fatalf("expected the example.com node's children to have been promoted to a map after %v inserts", n)
+	}
+}
+
+// TestDomainSetForEachDomainAfterPromotion verifies ForEachDomain still
+// visits every entry once the node holding them has promoted to a map
+func TestDomainSetForEachDomainAfterPromotion(t *testing.T) {
+	d := newDomainSet()
+
+	want := make(map[string]bool)
+	n := childMapThreshold + 4
+	for i := 0; i < n; i++ {
+		domain := fmt.Sprintf("n%d.example.com", i)
+		d.Add(domain)
+		want[domain] = true
+	}
+
+	got := make(map[string]bool)
+	err := d.ForEachDomain(func(name string) error {
+		got[name] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEachDomain returned error: %v", err)
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("ForEachDomain visited %v domains, want %v", len(got), len(want))
+	}
+	for domain := range want {
+		if !got[domain] {
+			t.Errorf("ForEachDomain didn't visit %q", domain)
+		}
+	}
+}